@@ -0,0 +1,62 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Annotations, modeled on the Civo cloud-controller-manager's LB annotation
+// scheme, that let a Service opt out of or customize how its forward(s) get
+// provisioned on the router.
+const (
+	// annotationExternalPort pins the WAN port a single-port Service is
+	// forwarded on, instead of deriving it from the Service's port. Ignored
+	// (with a log warning) on multi-port Services, since there's no way to
+	// map one port number onto several.
+	annotationExternalPort = "nodeport-router.misleb.github.io/external-port"
+
+	// annotationPublicIP binds the forward to a specific WAN IP, for routers
+	// that support more than one.
+	annotationPublicIP = "nodeport-router.misleb.github.io/public-ip"
+
+	// annotationProtocol is one of "tcp", "udp", or "both" (the default).
+	annotationProtocol = "nodeport-router.misleb.github.io/protocol"
+
+	// annotationSkip, set to "true", opts the Service out of forwarding
+	// entirely. Any forward already provisioned for it is removed on the
+	// next reconcile.
+	annotationSkip = "nodeport-router.misleb.github.io/skip"
+)
+
+// skipAnnotated reports whether service has opted out of forwarding.
+func skipAnnotated(service *corev1.Service) bool {
+	return service.Annotations[annotationSkip] == "true"
+}
+
+// protocolAnnotation returns the configured protocol, defaulting to "both".
+func protocolAnnotation(service *corev1.Service) string {
+	switch service.Annotations[annotationProtocol] {
+	case "tcp":
+		return "tcp"
+	case "udp":
+		return "udp"
+	default:
+		return "both"
+	}
+}
+
+// publicIPAnnotation returns the WAN IP the forward should be bound to, or
+// "" to let the router pick.
+func publicIPAnnotation(service *corev1.Service) string {
+	return service.Annotations[annotationPublicIP]
+}
+
+// forwardAnnotationsChanged reports whether any of the annotations that
+// affect forward provisioning differ between oldService and newService.
+func forwardAnnotationsChanged(oldService, newService *corev1.Service) bool {
+	for _, key := range []string{annotationExternalPort, annotationPublicIP, annotationProtocol, annotationSkip} {
+		if oldService.Annotations[key] != newService.Annotations[key] {
+			return true
+		}
+	}
+	return false
+}
@@ -3,25 +3,56 @@ package controller
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"strconv"
 	"time"
 
+	"github.com/misleb/nodeport-router/observability"
 	"github.com/misleb/nodeport-router/router"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	listersv1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
 )
 
+// DefaultReconcileInterval is how often Run performs a full reconcile when
+// Controller.ReconcileInterval is left at its zero value.
+const DefaultReconcileInterval = 60 * time.Second
+
+// reconcileKey is the single item enqueued to trigger a reconcile. Informer
+// events and the periodic ticker both just request "reconcile again" rather
+// than carrying per-object work, since a full reconcile is what actually
+// converges router state with the cache.
+const reconcileKey = "reconcile"
+
 type Controller struct {
 	K8sClient    kubernetes.Interface
-	RouterClient *router.RouterClient
+	RouterClient router.Driver
 	DeviceName   string // e.g., "bow0"
-	informer     cache.SharedInformer
+	DriverName   string // e.g., "arris", "upnp" - used only for logging/metric labels
+
+	// ReconcileInterval is how often to run a full reconcile between the
+	// cached NodePort services and the router's forwards. Defaults to
+	// DefaultReconcileInterval if zero.
+	ReconcileInterval time.Duration
+
+	// Ready, if set, is updated as the cache syncs so /readyz can gate on it.
+	Ready *observability.Readiness
+
+	informer cache.SharedInformer
+	lister   listersv1.ServiceLister
+	queue    workqueue.RateLimitingInterface
 }
 
 func (c *Controller) Run(ctx context.Context) error {
+	c.queue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer c.queue.ShutDown()
+
 	// Create an informer factory
 	// Use "" for all namespaces, or specify a namespace
 	informerFactory := informers.NewSharedInformerFactory(c.K8sClient, time.Second*30)
@@ -29,150 +60,383 @@ func (c *Controller) Run(ctx context.Context) error {
 	// Create a Service informer
 	serviceInformer := informerFactory.Core().V1().Services()
 
-	// Set up event handlers
+	// Set up event handlers. None of these talk to the router directly;
+	// they just request a reconcile, which is what actually diffs desired
+	// vs. actual state and issues Add/Delete calls.
 	serviceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc: func(obj interface{}) {
 			service := obj.(*corev1.Service)
-			if service.Spec.Type != corev1.ServiceTypeNodePort {
+			if !c.relevant(service) {
 				return
 			}
-			if err := c.handleServiceAdd(service); err != nil {
-				log.Printf("Error syncing service %s/%s: %v", service.Namespace, service.Name, err)
-			}
+			slog.Info("service added, queuing reconcile", "service", service.Name, "namespace", service.Namespace)
+			c.queue.Add(reconcileKey)
 		},
 		UpdateFunc: func(oldObj, newObj interface{}) {
 			oldService := oldObj.(*corev1.Service)
 			newService := newObj.(*corev1.Service)
 
-			// Only process NodePort services
-			if newService.Spec.Type != corev1.ServiceTypeNodePort {
+			if !c.relevant(oldService) && !c.relevant(newService) {
 				return
 			}
 
-			// Check if NodePort values actually changed
-			if c.nodePortsChanged(oldService, newService) {
-				log.Printf("NodePort changed for service %s/%s", newService.Namespace, newService.Name)
-				if err := c.handleServiceUpdate(oldService, newService); err != nil {
-					log.Printf("Error updating service %s/%s: %v", newService.Namespace, newService.Name, err)
-				}
-			} else {
-				log.Printf("NodePort values did not change for service %s/%s", newService.Namespace, newService.Name)
+			if !c.nodePortsChanged(oldService, newService) && !forwardAnnotationsChanged(oldService, newService) {
+				return
 			}
+
+			slog.Info("service forwarding config changed, queuing reconcile", "service", newService.Name, "namespace", newService.Namespace)
+			c.queue.Add(reconcileKey)
 		},
 		DeleteFunc: func(obj interface{}) {
-			service := obj.(*corev1.Service)
-			if service.Spec.Type != corev1.ServiceTypeNodePort {
+			service, ok := obj.(*corev1.Service)
+			if !ok {
+				// obj may be a cache.DeletedFinalStateUnknown tombstone; a reconcile
+				// will still clean up any forward that's no longer backed by a service.
+				c.queue.Add(reconcileKey)
 				return
 			}
-			if err := c.handleServiceDelete(service); err != nil {
-				log.Printf("Error deleting service %s/%s: %v", service.Namespace, service.Name, err)
+			if !c.relevant(service) {
+				return
 			}
+			slog.Info("service deleted, queuing reconcile", "service", service.Name, "namespace", service.Namespace)
+			c.queue.Add(reconcileKey)
 		},
 	})
 
 	c.informer = serviceInformer.Informer()
+	c.lister = serviceInformer.Lister()
 
 	// Start the informer
-	log.Println("Starting informer...")
+	slog.Info("starting informer")
 	informerFactory.Start(ctx.Done())
 
 	// Wait for the cache to sync
-	log.Println("Waiting for cache to sync...")
+	slog.Info("waiting for cache to sync")
 	if !cache.WaitForCacheSync(ctx.Done(), c.informer.HasSynced) {
 		return fmt.Errorf("failed to sync cache")
 	}
+	if c.Ready != nil {
+		c.Ready.SetCacheSynced(true)
+	}
+
+	slog.Info("running initial reconcile")
+	if err := c.reconcile(ctx); err != nil {
+		slog.Error("initial reconcile failed", "error", err)
+	}
+
+	slog.Info("started watching services", "device", c.DeviceName, "driver", c.DriverName)
+	go c.runWorker(ctx)
 
-	log.Println("Started watching Services for NodePort changes...")
+	interval := c.ReconcileInterval
+	if interval <= 0 {
+		interval = DefaultReconcileInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				c.queue.Add(reconcileKey)
+			}
+		}
+	}()
 
 	// Block until context is cancelled
 	<-ctx.Done()
 	return ctx.Err()
 }
 
-// nodePortsChanged checks if NodePort values changed between old and new service
-func (c *Controller) nodePortsChanged(oldService, newService *corev1.Service) bool {
-	oldPorts := make(map[string]string) // port name -> nodePort+port
-	newPorts := make(map[string]string) // port name -> nodePort+port
+// relevant reports whether service is a type we provision forwards for.
+func (c *Controller) relevant(service *corev1.Service) bool {
+	if skipAnnotated(service) {
+		return false
+	}
+	return service.Spec.Type == corev1.ServiceTypeNodePort || service.Spec.Type == corev1.ServiceTypeLoadBalancer
+}
 
-	for _, port := range oldService.Spec.Ports {
-		if port.NodePort != 0 {
-			oldPorts[port.Name] = fmt.Sprintf("%d-%d", port.NodePort, port.Port)
-		}
+// runWorker drains the workqueue until it is shut down, rate-limiting
+// retries so a transient router error doesn't spin tightly or drop the item.
+func (c *Controller) runWorker(ctx context.Context) {
+	for c.processNextItem(ctx) {
 	}
+}
 
-	for _, port := range newService.Spec.Ports {
-		if port.NodePort != 0 {
-			newPorts[port.Name] = fmt.Sprintf("%d-%d", port.NodePort, port.Port)
-		}
+func (c *Controller) processNextItem(ctx context.Context) bool {
+	key, shutdown := c.queue.Get()
+	if shutdown {
+		return false
 	}
+	defer c.queue.Done(key)
 
-	// Check if maps are different
-	return !equality.Semantic.DeepEqual(oldPorts, newPorts)
+	if err := c.reconcile(ctx); err != nil {
+		slog.Error("reconcile failed, will retry", "error", err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+
+	c.queue.Forget(key)
+	return true
 }
 
-// handleServiceUpdate handles updates where NodePort values changed
-func (c *Controller) handleServiceUpdate(oldService, newService *corev1.Service) error {
-	// Extract old and new forwards
-	oldForwards := c.affectedForwards(oldService)
-	newForwards := c.affectedForwards(newService)
+// reconcile computes the desired forwards from every cached NodePort and
+// LoadBalancer service, lists the forwards actually configured on the
+// router, and issues Add/Delete calls to converge the two. This repairs
+// drift from forwards manually removed on the router, lost on reboot, or
+// missed while the controller was down. Once forwards are confirmed on the
+// router, matching LoadBalancer services have their status.loadBalancer
+// updated with the assigned external address.
+func (c *Controller) reconcile(ctx context.Context) error {
+	start := time.Now()
+	defer func() { observability.ObserveReconcileDuration(time.Since(start)) }()
 
-	for _, forward := range oldForwards {
-		if err := c.RouterClient.DeleteForward(forward); err != nil {
-			// Not a fatal error, just log it.
-			log.Printf("error deleting forward for service %s: %v", oldService.Name, err)
+	services, err := c.lister.List(labels.Everything())
+	if err != nil {
+		return fmt.Errorf("listing cached services: %v", err)
+	}
+
+	desired := map[string]router.Forward{}
+	for _, service := range services {
+		if !c.relevant(service) {
+			continue
+		}
+		for _, forward := range c.affectedForwards(service) {
+			desired[forward.ServiceName] = forward
 		}
 	}
 
-	for _, forward := range newForwards {
-		if err := c.RouterClient.AddForward(forward); err != nil {
-			return fmt.Errorf("error adding forward for service %s: %v", newService.Name, err)
+	actual, err := c.RouterClient.ListForwards()
+	observability.RecordRouterCall(c.DriverName, "list", err)
+	if err != nil {
+		return fmt.Errorf("listing router forwards: %v", err)
+	}
+	// Drivers that submit "both" as separate TCP and UDP mappings (upnp) report
+	// them back from ListForwards as two entries sharing a ServiceName; merge
+	// those into one Protocol: "both" entry so they're compared and deleted as
+	// the single logical forward they were added as.
+	actualByName := map[string]router.Forward{}
+	for _, forward := range actual {
+		if existing, ok := actualByName[forward.ServiceName]; ok && existing.Protocol != forward.Protocol {
+			existing.Protocol = "both"
+			actualByName[forward.ServiceName] = existing
+			continue
 		}
+		actualByName[forward.ServiceName] = forward
+	}
 
-		log.Printf("Updated NodePort %s -> %s for service %s/%s",
-			forward.DevicePort, forward.Ports, newService.Namespace, newService.Name)
+	for name, forward := range actualByName {
+		if _, ok := desired[name]; !ok {
+			err := c.RouterClient.DeleteForward(forward)
+			observability.RecordRouterCall(c.DriverName, "delete", err)
+			if err != nil {
+				return fmt.Errorf("removing stale forward %s: %v", name, err)
+			}
+			slog.Info("reconcile removed stale forward", "forward", name, "device", c.DeviceName)
+			delete(actualByName, name)
+		}
+	}
+
+	for name, forward := range desired {
+		current, matches := actualByName[name]
+		if matches && current.Ports == forward.Ports && current.DevicePort == forward.DevicePort &&
+			current.Protocol == forward.Protocol && current.PublicIP == forward.PublicIP {
+			continue
+		}
+
+		if matches {
+			// The existing entry is stale (ports, protocol, or public IP changed):
+			// it must be removed before re-adding, since the Arris scraper's "Add"
+			// submits a new apphosting entry rather than updating one in place,
+			// and a leftover duplicate breaks DeleteForward's by-name lookup.
+			err := c.RouterClient.DeleteForward(current)
+			observability.RecordRouterCall(c.DriverName, "delete", err)
+			if err != nil {
+				return fmt.Errorf("removing stale forward %s before re-adding: %v", name, err)
+			}
+		}
+
+		err := c.RouterClient.AddForward(forward)
+		observability.RecordRouterCall(c.DriverName, "add", err)
+		if err != nil {
+			return fmt.Errorf("adding missing forward %s: %v", name, err)
+		}
+		slog.Info("reconcile added forward", "forward", name, "nodePort", forward.DevicePort, "device", c.DeviceName)
+		actualByName[name] = forward
 	}
 
+	observability.Forwards.Set(float64(len(actualByName)))
+
+	c.updateLoadBalancerStatus(ctx, services, actualByName)
+
 	return nil
 }
 
-func (c *Controller) handleServiceAdd(service *corev1.Service) error {
-	// Extract NodePort(s) from service
-	forwards := c.affectedForwards(service)
+// updateLoadBalancerStatus patches status.loadBalancer.ingress on every
+// LoadBalancer service whose forward is confirmed present in actualByName,
+// so kubectl and other tooling can see the externally reachable address and
+// port. Services that stop being relevant (e.g. newly skip-annotated) have
+// their stale ingress status cleared instead. Failures are logged, not
+// returned, so one service's status update can't block forwards from
+// converging for the rest.
+func (c *Controller) updateLoadBalancerStatus(ctx context.Context, services []*corev1.Service, actualByName map[string]router.Forward) {
+	for _, service := range services {
+		if service.Spec.Type != corev1.ServiceTypeLoadBalancer {
+			continue
+		}
+
+		if !c.relevant(service) {
+			c.clearLoadBalancerStatus(ctx, service)
+			continue
+		}
+
+		ingress := loadBalancerIngress(c.affectedForwards(service), actualByName)
+		if len(ingress) == 0 || equality.Semantic.DeepEqual(service.Status.LoadBalancer.Ingress, ingress) {
+			continue
+		}
+
+		updated := service.DeepCopy()
+		updated.Status.LoadBalancer.Ingress = ingress
+		if _, err := c.K8sClient.CoreV1().Services(service.Namespace).UpdateStatus(ctx, updated, metav1.UpdateOptions{}); err != nil {
+			slog.Error("updating LoadBalancer status failed", "service", service.Name, "namespace", service.Namespace, "error", err)
+			continue
+		}
+		slog.Info("updated LoadBalancer status", "service", service.Name, "namespace", service.Namespace)
+	}
+}
+
+// loadBalancerIngress builds one corev1.LoadBalancerIngress per distinct
+// public IP the service's confirmed forwards resolve to, with a PortStatus
+// entry per forwarded port/protocol, so a multi-port service doesn't end up
+// with duplicate, port-less ingress entries for the same IP.
+func loadBalancerIngress(forwards []router.Forward, actualByName map[string]router.Forward) []corev1.LoadBalancerIngress {
+	var ips []string
+	portsByIP := map[string][]corev1.PortStatus{}
 
 	for _, forward := range forwards {
-		if err := c.RouterClient.AddForward(forward); err != nil {
-			return fmt.Errorf("error syncing forward for service %s: %v", service.Name, err)
+		actualForward, ok := actualByName[forward.ServiceName]
+		if !ok {
+			continue
+		}
+		ip := forward.PublicIP
+		if ip == "" {
+			ip = actualForward.PublicIP
 		}
+		if ip == "" {
+			continue
+		}
+
+		port, err := strconv.Atoi(forward.Ports)
+		if err != nil {
+			slog.Warn("forward has a non-numeric external port, omitting it from LoadBalancer status",
+				"service", forward.ServiceName, "ports", forward.Ports, "error", err)
+			continue
+		}
+
+		if _, ok := portsByIP[ip]; !ok {
+			ips = append(ips, ip)
+		}
+		for _, protocol := range portStatusProtocols(forward.Protocol) {
+			portsByIP[ip] = append(portsByIP[ip], corev1.PortStatus{Port: int32(port), Protocol: protocol})
+		}
+	}
 
-		log.Printf("Added NodePort %s -> %s for service %s/%s",
-			forward.DevicePort, forward.Ports, service.Namespace, service.Name)
+	ingress := make([]corev1.LoadBalancerIngress, 0, len(ips))
+	for _, ip := range ips {
+		ingress = append(ingress, corev1.LoadBalancerIngress{IP: ip, Ports: portsByIP[ip]})
 	}
+	return ingress
+}
 
-	return nil
+// portStatusProtocols expands a Forward's "tcp"/"udp"/"both"/"" protocol
+// into the corev1.Protocol values PortStatus expects.
+func portStatusProtocols(protocol string) []corev1.Protocol {
+	switch protocol {
+	case "tcp":
+		return []corev1.Protocol{corev1.ProtocolTCP}
+	case "udp":
+		return []corev1.Protocol{corev1.ProtocolUDP}
+	default:
+		return []corev1.Protocol{corev1.ProtocolTCP, corev1.ProtocolUDP}
+	}
 }
 
-func (c *Controller) handleServiceDelete(service *corev1.Service) error {
-	log.Printf("Service %s/%s deleted, removing port forwards", service.Namespace, service.Name)
-	forwards := c.affectedForwards(service)
-	for _, forward := range forwards {
-		if err := c.RouterClient.DeleteForward(forward); err != nil {
-			return fmt.Errorf("error deleting forward for service %s: %v", service.Name, err)
+// clearLoadBalancerStatus removes a previously published ingress status from
+// a LoadBalancer service that's no longer relevant (e.g. skip-annotated),
+// since reconcile's stale-forward cleanup tears down the forward itself but
+// has no reason to touch services it's no longer considering.
+func (c *Controller) clearLoadBalancerStatus(ctx context.Context, service *corev1.Service) {
+	if len(service.Status.LoadBalancer.Ingress) == 0 {
+		return
+	}
+
+	updated := service.DeepCopy()
+	updated.Status.LoadBalancer.Ingress = nil
+	if _, err := c.K8sClient.CoreV1().Services(service.Namespace).UpdateStatus(ctx, updated, metav1.UpdateOptions{}); err != nil {
+		slog.Error("clearing stale LoadBalancer status failed", "service", service.Name, "namespace", service.Namespace, "error", err)
+		return
+	}
+	slog.Info("cleared stale LoadBalancer status", "service", service.Name, "namespace", service.Namespace)
+}
+
+// nodePortsChanged checks if NodePort values changed between old and new service
+func (c *Controller) nodePortsChanged(oldService, newService *corev1.Service) bool {
+	oldPorts := make(map[string]string) // port name -> nodePort+port
+	newPorts := make(map[string]string) // port name -> nodePort+port
+
+	for _, port := range oldService.Spec.Ports {
+		if port.NodePort != 0 {
+			oldPorts[port.Name] = fmt.Sprintf("%d-%d", port.NodePort, port.Port)
 		}
-		log.Printf("Removed NodePort %s -> %s for service %s/%s",
-			forward.DevicePort, forward.Ports, service.Namespace, service.Name)
 	}
-	return nil
+
+	for _, port := range newService.Spec.Ports {
+		if port.NodePort != 0 {
+			newPorts[port.Name] = fmt.Sprintf("%d-%d", port.NodePort, port.Port)
+		}
+	}
+
+	// Check if maps are different
+	return !equality.Semantic.DeepEqual(oldPorts, newPorts)
 }
 
 func (c *Controller) affectedForwards(service *corev1.Service) []router.Forward {
+	if skipAnnotated(service) {
+		return nil
+	}
+
+	protocol := protocolAnnotation(service)
+	publicIP := publicIPAnnotation(service)
+
+	externalPort, hasExternalPort := 0, false
+	if raw, ok := service.Annotations[annotationExternalPort]; ok {
+		port, err := strconv.Atoi(raw)
+		if err != nil {
+			slog.Warn("invalid external-port annotation, ignoring it",
+				"service", service.Name, "namespace", service.Namespace, "annotation", annotationExternalPort, "value", raw, "error", err)
+		} else if len(service.Spec.Ports) != 1 {
+			slog.Warn("external-port annotation set on a multi-port service, ignoring it",
+				"service", service.Name, "namespace", service.Namespace, "annotation", annotationExternalPort, "ports", len(service.Spec.Ports))
+		} else {
+			externalPort, hasExternalPort = port, true
+		}
+	}
+
 	forwards := []router.Forward{}
 	for _, port := range service.Spec.Ports {
 		if port.NodePort == 0 {
 			continue
 		}
+		wanPort := port.Port
+		if hasExternalPort {
+			wanPort = int32(externalPort)
+		}
 		forwards = append(forwards, router.Forward{
 			DeviceName:  c.DeviceName,
-			Ports:       fmt.Sprintf("%d", port.Port),
+			PublicIP:    publicIP,
+			Protocol:    protocol,
+			Ports:       fmt.Sprintf("%d", wanPort),
 			DevicePort:  fmt.Sprintf("%d", port.NodePort),
 			ServiceName: fmt.Sprintf("%s-%s-%d-%d", service.Namespace, service.Name, port.Port, port.NodePort),
 		})
@@ -2,34 +2,154 @@ package main
 
 import (
 	"context"
-	"log"
+	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/misleb/nodeport-router/controller"
+	"github.com/misleb/nodeport-router/observability"
 	"github.com/misleb/nodeport-router/router"
+	"github.com/misleb/nodeport-router/router/drivers/arris"
+	"github.com/misleb/nodeport-router/router/drivers/upnp"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
 )
 
-func main() {
-	_ = godotenv.Load(".env")
-	deviceName, ok := os.LookupEnv("K8S_HOST")
-	if !ok {
-		log.Fatalf("K8S_HOST is not set")
+// newDriver builds the router.Driver selected by the ROUTER_DRIVER env var
+// (default "arris"), reading whatever driver-specific env vars it needs.
+// It returns the driver name alongside it for logging/metric labels.
+func newDriver() (router.Driver, string, error) {
+	driverName := os.Getenv("ROUTER_DRIVER")
+	if driverName == "" {
+		driverName = "arris"
 	}
-	baseURL, ok := os.LookupEnv("ROUTER_BASE")
-	if !ok {
-		log.Fatalf("ROUTER_BASE is not set")
+
+	switch driverName {
+	case "arris":
+		baseURL, ok := os.LookupEnv("ROUTER_BASE")
+		if !ok {
+			slog.Error("ROUTER_BASE is not set")
+			os.Exit(1)
+		}
+		routerAdmin, ok := os.LookupEnv("ROUTER_ADMIN")
+		if !ok {
+			slog.Error("ROUTER_ADMIN is not set")
+			os.Exit(1)
+		}
+		routerPass, ok := os.LookupEnv("ROUTER_PASS")
+		if !ok {
+			slog.Error("ROUTER_PASS is not set")
+			os.Exit(1)
+		}
+		return arris.New(baseURL, routerAdmin, routerPass), driverName, nil
+	case "upnp":
+		internalClient, ok := os.LookupEnv("UPNP_INTERNAL_CLIENT")
+		if !ok {
+			slog.Error("UPNP_INTERNAL_CLIENT is not set")
+			os.Exit(1)
+		}
+		client, err := upnp.New(internalClient)
+		return client, driverName, err
+	default:
+		return nil, "", fmt.Errorf("unknown ROUTER_DRIVER %q", driverName)
 	}
-	routerAdmin, ok := os.LookupEnv("ROUTER_ADMIN")
-	if !ok {
-		log.Fatalf("ROUTER_ADMIN is not set")
+}
+
+// loginToRouter authenticates routerClient and marks ready as logged in on
+// success. Only the elected leader (or the sole replica, when leader
+// election is disabled) may call this: racing a login against the current
+// leader's session can invalidate it on single-session CPE admin UIs.
+func loginToRouter(routerClient router.Driver, driverName string, ready *observability.Readiness) error {
+	slog.Info("authenticating to router", "driver", driverName)
+	err := routerClient.Login()
+	observability.RecordRouterCall(driverName, "login", err)
+	if err != nil {
+		return err
+	}
+	ready.SetLoggedIn(true)
+	return nil
+}
+
+// runWithLeaderElection blocks running ctrl.Run only while this process
+// holds the coordination.k8s.io/Lease named by LEADER_ELECTION_LEASE_NAME
+// in LEADER_ELECTION_NAMESPACE. Most home routers (including the Arris
+// NVG443B the arris driver targets) will corrupt state or reject concurrent
+// form submissions, so standbys must not touch the router at all while
+// waiting to become leader - including logging in, which is why the login
+// itself happens inside OnStartedLeading rather than before this is called.
+func runWithLeaderElection(ctx context.Context, k8sClient kubernetes.Interface, routerClient router.Driver, driverName string, ready *observability.Readiness, ctrl *controller.Controller) error {
+	namespace := os.Getenv("LEADER_ELECTION_NAMESPACE")
+	if namespace == "" {
+		namespace = "default"
+	}
+	leaseName := os.Getenv("LEADER_ELECTION_LEASE_NAME")
+	if leaseName == "" {
+		leaseName = "nodeport-router-leader"
+	}
+
+	identity, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("determining leader election identity: %v", err)
 	}
-	routerPass, ok := os.LookupEnv("ROUTER_PASS")
+
+	lock, err := resourcelock.New(
+		resourcelock.LeasesResourceLock,
+		namespace,
+		leaseName,
+		k8sClient.CoreV1(),
+		k8sClient.CoordinationV1(),
+		resourcelock.ResourceLockConfig{Identity: identity},
+	)
+	if err != nil {
+		return fmt.Errorf("creating leader election lock: %v", err)
+	}
+
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		ReleaseOnCancel: true,
+		LeaseDuration:   15 * time.Second,
+		RenewDeadline:   10 * time.Second,
+		RetryPeriod:     2 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				slog.Info("acquired leader lease", "identity", identity, "lease", leaseName)
+				if err := loginToRouter(routerClient, driverName, ready); err != nil {
+					slog.Error("error logging in to router", "error", err)
+					os.Exit(1)
+				}
+				if err := ctrl.Run(ctx); err != nil && ctx.Err() == nil {
+					slog.Error("controller exited with error", "error", err)
+					os.Exit(1)
+				}
+			},
+			OnStoppedLeading: func() {
+				slog.Info("lost leader lease, exiting so Kubernetes restarts us as a standby", "identity", identity)
+				os.Exit(1)
+			},
+			OnNewLeader: func(currentID string) {
+				if currentID != identity {
+					slog.Info("standing by, another replica is leader", "leader", currentID)
+				}
+			},
+		},
+	})
+
+	return nil
+}
+
+func main() {
+	_ = godotenv.Load(".env")
+	deviceName, ok := os.LookupEnv("K8S_HOST")
 	if !ok {
-		log.Fatalf("ROUTER_PASS is not set")
+		slog.Error("K8S_HOST is not set")
+		os.Exit(1)
 	}
 
 	// Initialize Kubernetes client (works in-cluster or from kubeconfig)
@@ -38,30 +158,67 @@ func main() {
 		// Fallback to kubeconfig if not in cluster
 		config, err = clientcmd.BuildConfigFromFlags("", clientcmd.RecommendedHomeFile)
 		if err != nil {
-			log.Fatalf("Error building kubeconfig: %v", err)
+			slog.Error("error building kubeconfig", "error", err)
+			os.Exit(1)
 		}
 	}
 
 	k8sClient, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		log.Fatalf("Error creating Kubernetes client: %v", err)
+		slog.Error("error creating Kubernetes client", "error", err)
+		os.Exit(1)
 	}
 
-	routerClient := router.NewRouterClient(baseURL, routerAdmin, routerPass)
-	log.Println("Authenticating to", baseURL)
-	if err := routerClient.Login(); err != nil {
-		log.Fatalf("Error logging in to router: %v", err)
+	routerClient, driverName, err := newDriver()
+	if err != nil {
+		slog.Error("error configuring router driver", "error", err)
+		os.Exit(1)
 	}
 
+	ready := &observability.Readiness{}
+
+	healthAddr := os.Getenv("HEALTH_ADDR")
+	if healthAddr == "" {
+		healthAddr = ":8080"
+	}
+	healthServer := observability.NewServer(healthAddr, ready)
+	go func() {
+		slog.Info("starting health/metrics server", "addr", healthAddr)
+		if err := healthServer.ListenAndServe(); err != nil {
+			slog.Error("health/metrics server stopped", "error", err)
+		}
+	}()
+
 	controller := controller.Controller{
 		K8sClient:    k8sClient,
 		RouterClient: routerClient,
 		DeviceName:   deviceName,
+		DriverName:   driverName,
+		Ready:        ready,
+	}
+
+	// Start watching Services. Cancelling on SIGINT/SIGTERM lets
+	// runWithLeaderElection's ReleaseOnCancel give up the lease immediately
+	// on shutdown instead of leaving standbys waiting out the full
+	// LeaseDuration for it to expire.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if os.Getenv("ENABLE_LEADER_ELECTION") == "true" {
+		if err := runWithLeaderElection(ctx, k8sClient, routerClient, driverName, ready, &controller); err != nil {
+			slog.Error("error running controller under leader election", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := loginToRouter(routerClient, driverName, ready); err != nil {
+		slog.Error("error logging in to router", "error", err)
+		os.Exit(1)
 	}
 
-	// Start watching Services
-	ctx := context.Background()
 	if err := controller.Run(ctx); err != nil {
-		log.Fatalf("Error running controller: %v", err)
+		slog.Error("error running controller", "error", err)
+		os.Exit(1)
 	}
 }
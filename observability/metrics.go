@@ -0,0 +1,49 @@
+// Package observability holds the Prometheus metrics and health/readiness
+// server shared by the controller and router drivers, so the controller can
+// run as a real Kubernetes Deployment with liveness/readiness probes.
+package observability
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	// RouterCalls counts every call made to a router.Driver, labeled by
+	// driver name, operation ("login", "add", "delete", "list"), and
+	// outcome ("success"/"error").
+	RouterCalls = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "nodeport_router_calls_total",
+		Help: "Total number of calls made to the router driver.",
+	}, []string{"driver", "operation", "outcome"})
+
+	// ReconcileDuration observes how long each full reconcile takes.
+	ReconcileDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "nodeport_router_reconcile_duration_seconds",
+		Help:    "Duration of a full reconcile between cached services and router forwards.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// Forwards tracks the number of forwards currently configured on the
+	// router, as observed by the last reconcile.
+	Forwards = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "nodeport_router_forwards",
+		Help: "Current number of port forwards configured on the router.",
+	})
+)
+
+// RecordRouterCall records the outcome of a router.Driver call.
+func RecordRouterCall(driver, operation string, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	RouterCalls.WithLabelValues(driver, operation, outcome).Inc()
+}
+
+// ObserveReconcileDuration records how long a reconcile took.
+func ObserveReconcileDuration(d time.Duration) {
+	ReconcileDuration.Observe(d.Seconds())
+}
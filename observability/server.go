@@ -0,0 +1,46 @@
+package observability
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Readiness tracks the conditions the /readyz endpoint gates on: the
+// informer cache has synced at least once, and the router driver has
+// logged in successfully at least once.
+type Readiness struct {
+	cacheSynced atomic.Bool
+	loggedIn    atomic.Bool
+}
+
+func (r *Readiness) SetCacheSynced(synced bool) { r.cacheSynced.Store(synced) }
+func (r *Readiness) SetLoggedIn(loggedIn bool)  { r.loggedIn.Store(loggedIn) }
+
+// Ready reports whether both conditions are currently satisfied.
+func (r *Readiness) Ready() bool {
+	return r.cacheSynced.Load() && r.loggedIn.Load()
+}
+
+// NewServer returns an *http.Server exposing /metrics, /healthz, and
+// /readyz on addr. It is not started; call ListenAndServe yourself so the
+// caller controls shutdown.
+func NewServer(addr string, ready *Readiness) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	return &http.Server{Addr: addr, Handler: mux}
+}
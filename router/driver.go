@@ -0,0 +1,35 @@
+package router
+
+// Package router defines the vendor-neutral contract that the controller
+// drives. Concrete CPE support lives under router/drivers/*; the controller
+// and main.go should only ever depend on the Driver interface below.
+
+// Forward represents a single WAN->LAN port forward entry.
+type Forward struct {
+	PublicIP    string // The WAN IP of the router to bind the forward to, if the router supports more than one
+	DeviceName  string // The name of the cluster as known by the router
+	ServiceName string // The name of the service that the forward is mapped to (namespace-name-port)
+	Ports       string // The port on the WAN interface of the router that the forward is mapped to
+	DevicePort  string // The port on the cluster that the forward is mapped to
+	Protocol    string // "tcp", "udp", or "both" (default "both" if empty)
+	DeleteID    string // The ID of the forward in the router, used to delete it (driver-specific, may be unused)
+}
+
+// Driver is implemented by each supported router/CPE backend. Implementations
+// are responsible for their own authentication and session management;
+// Login is expected to be safe to call repeatedly to refresh an expired
+// session.
+type Driver interface {
+	// Login authenticates to the device. Drivers that are stateless/tokenless
+	// may treat this as a no-op health check.
+	Login() error
+
+	// AddForward provisions a new port forward on the device.
+	AddForward(forward Forward) error
+
+	// DeleteForward removes the forward matching forward.ServiceName.
+	DeleteForward(forward Forward) error
+
+	// ListForwards returns the forwards currently configured on the device.
+	ListForwards() ([]Forward, error)
+}
@@ -1,7 +1,6 @@
-package router
-
-// This client supports the following routers:
-// - Arris NVG443B
+// Package arris implements router.Driver for the Arris NVG443B by scraping
+// its web admin UI, since the device exposes no programmatic API.
+package arris
 
 import (
 	"fmt"
@@ -13,19 +12,12 @@ import (
 	"sync"
 	"time"
 
+	"github.com/misleb/nodeport-router/router"
 	"golang.org/x/net/html"
 )
 
-type Forward struct {
-	PublicIP    string // The WAN IP of the router (not used but could be useful)
-	DeviceName  string // The name of the cluster as known by the router
-	ServiceName string // The name of the service that the forward is mapped to (namespace-name-port)
-	Ports       string // The port on the WAN interface of the router that the forward is mapped to
-	DevicePort  string // The port on the cluster that the forward is mapped to
-	DeleteID    string // The ID of the forward in the router, used to delete it
-}
-
-type RouterClient struct {
+// Client drives an Arris NVG443B over its HTML admin UI.
+type Client struct {
 	client     *http.Client
 	baseURL    string
 	username   string
@@ -34,10 +26,11 @@ type RouterClient struct {
 	lastLogin  time.Time
 }
 
-func NewRouterClient(baseURL, username, password string) *RouterClient {
+// New returns a Client for the NVG443B at baseURL.
+func New(baseURL, username, password string) *Client {
 	jar, _ := cookiejar.New(nil)
 
-	return &RouterClient{
+	return &Client{
 		client: &http.Client{
 			Jar: jar,
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
@@ -50,7 +43,7 @@ func NewRouterClient(baseURL, username, password string) *RouterClient {
 	}
 }
 
-func (c *RouterClient) Login() error {
+func (c *Client) Login() error {
 	loginPageURL := c.baseURL + "/cgi-bin/login.ha"
 
 	resp, err := c.client.Get(loginPageURL)
@@ -90,9 +83,12 @@ func (c *RouterClient) Login() error {
 	return nil
 }
 
-func (c *RouterClient) DeleteForward(forward Forward) error {
-	forwards := []Forward{}
-	nonce, err := c.GetForwards(&forwards)
+func (c *Client) DeleteForward(forward router.Forward) error {
+	if err := c.EnsureLoggedIn(); err != nil {
+		return fmt.Errorf("refreshing session: %v", err)
+	}
+
+	forwards, nonce, err := c.getForwards()
 	if err != nil {
 		return fmt.Errorf("error getting forwards: %v", err)
 	}
@@ -127,15 +123,22 @@ func (c *RouterClient) DeleteForward(forward Forward) error {
 	return nil
 }
 
-func (c *RouterClient) AddForward(forward Forward) error {
-	forwards := []Forward{}
+func (c *Client) AddForward(forward router.Forward) error {
+	if err := c.EnsureLoggedIn(); err != nil {
+		return fmt.Errorf("refreshing session: %v", err)
+	}
 
-	// To add a forward we need to get the nonce to submit the form
-	// We may never use the forwards array, but it's a convenient way to get the nonce
-	nonce, err := c.GetForwards(&forwards)
+	// To add a forward we need to get the nonce to submit the form.
+	// We may never use the forwards array, but it's a convenient way to get it.
+	_, nonce, err := c.getForwards()
 	if err != nil {
 		return fmt.Errorf("getting forwards: %v", err)
 	}
+	protocol := forward.Protocol
+	if protocol == "" {
+		protocol = "both"
+	}
+
 	addForwardURL := c.baseURL + "/cgi-bin/apphosting.ha"
 	data := url.Values{}
 	data.Set("nonce", nonce)
@@ -143,11 +146,11 @@ func (c *RouterClient) AddForward(forward Forward) error {
 	data.Set("device_manual", forward.DeviceName)
 	data.Set("serviceName", forward.ServiceName)
 	data.Set("service", "custom")
-	data.Set("protocol", "both")
+	data.Set("protocol", protocol)
 	data.Set("extMinPort", forward.Ports)
 	data.Set("extMaxPort", "")
 	data.Set("intStartPort", forward.DevicePort)
-	data.Set("publicip", "")
+	data.Set("publicip", forward.PublicIP)
 	data.Set("Add", "Add")
 
 	req, err := http.NewRequest("POST", addForwardURL, strings.NewReader(data.Encode()))
@@ -164,7 +167,7 @@ func (c *RouterClient) AddForward(forward Forward) error {
 	return nil
 }
 
-func (r *RouterClient) EnsureLoggedIn() error {
+func (r *Client) EnsureLoggedIn() error {
 	r.sessionMux.Lock()
 	defer r.sessionMux.Unlock()
 
@@ -175,31 +178,44 @@ func (r *RouterClient) EnsureLoggedIn() error {
 	return nil
 }
 
-func (c *RouterClient) GetForwards(forwards *[]Forward) (string, error) {
+// ListForwards returns the forwards currently configured on the device.
+func (c *Client) ListForwards() ([]router.Forward, error) {
+	if err := c.EnsureLoggedIn(); err != nil {
+		return nil, fmt.Errorf("refreshing session: %v", err)
+	}
+
+	forwards, _, err := c.getForwards()
+	return forwards, err
+}
+
+// getForwards scrapes the apphosting page, returning both the parsed
+// forwards and the nonce needed to submit the add/delete forms on that page.
+func (c *Client) getForwards() ([]router.Forward, string, error) {
 	apphostingURL := c.baseURL + "/cgi-bin/apphosting.ha"
 	resp, err := c.client.Get(apphostingURL)
 	if err != nil {
-		return "", fmt.Errorf("error fetching apphosting page: %v", err)
+		return nil, "", fmt.Errorf("error fetching apphosting page: %v", err)
 	}
 	defer resp.Body.Close()
 
 	bodyBytes, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return "", fmt.Errorf("error reading response body: %v", err)
+		return nil, "", fmt.Errorf("error reading response body: %v", err)
 	}
 
 	// Parse the HTML
 	doc, err := html.Parse(strings.NewReader(string(bodyBytes)))
 	if err != nil {
-		return "", fmt.Errorf("error parsing HTML: %v", err)
+		return nil, "", fmt.Errorf("error parsing HTML: %v", err)
 	}
 
-	// Find and print the table with class="grid table100"
+	// Find the table with class="grid table100"
 	table := findTableByClass(doc, "grid table100")
 	if table == nil {
-		return "", fmt.Errorf("could not find table with class 'grid table100'")
+		return nil, "", fmt.Errorf("could not find table with class 'grid table100'")
 	}
 
+	var forwards []router.Forward
 	rows := findElements(table, "tr")
 	for i, row := range rows {
 		if i == 0 {
@@ -214,30 +230,39 @@ func (c *RouterClient) GetForwards(forwards *[]Forward) (string, error) {
 			cellTexts = append(cellTexts, text)
 		}
 
-		*forwards = append(*forwards, Forward{
+		// Some firmware revisions of the apphosting table add a trailing
+		// protocol cell after DeleteID; tolerate its absence rather than
+		// indexing out of range on older ones.
+		protocol := ""
+		if len(cellTexts) > 5 {
+			protocol = normalizeProtocol(cellTexts[5])
+		}
+
+		forwards = append(forwards, router.Forward{
 			PublicIP:    cellTexts[1],
 			DeviceName:  cellTexts[0],
 			ServiceName: cellTexts[2],
 			Ports:       cellTexts[3],
+			Protocol:    protocol,
 			DeleteID:    cellTexts[4],
 		})
 	}
 
 	nonce := extractNonce(string(bodyBytes))
 	if nonce == "" {
-		return "", fmt.Errorf("could not find nonce in apphosting page")
+		return nil, "", fmt.Errorf("could not find nonce in apphosting page")
 	}
 
-	return nonce, nil
+	return forwards, nonce, nil
 }
 
-func (c *RouterClient) setHeaders(req *http.Request) {
+func (c *Client) setHeaders(req *http.Request) {
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("Origin", c.baseURL)
 	req.Header.Set("Referer", req.URL.String())
 }
 
-func (c *RouterClient) doRequest(req *http.Request) error {
+func (c *Client) doRequest(req *http.Request) error {
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return fmt.Errorf("error making request: %v", err)
@@ -278,3 +303,6 @@ func (c *RouterClient) doRequest(req *http.Request) error {
 
 	return nil
 }
+
+// compile-time assertion that Client satisfies router.Driver.
+var _ router.Driver = (*Client)(nil)
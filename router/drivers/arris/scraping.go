@@ -1,4 +1,4 @@
-package router
+package arris
 
 import (
 	"regexp"
@@ -16,6 +16,24 @@ func extractNonce(htmlStr string) string {
 	return ""
 }
 
+// normalizeProtocol maps the apphosting table's protocol text (e.g. "TCP",
+// "UDP", "TCP/UDP") onto the "tcp"/"udp"/"both" values router.Forward uses.
+func normalizeProtocol(s string) string {
+	s = strings.ToLower(s)
+	hasTCP := strings.Contains(s, "tcp")
+	hasUDP := strings.Contains(s, "udp")
+	switch {
+	case hasTCP && hasUDP:
+		return "both"
+	case hasTCP:
+		return "tcp"
+	case hasUDP:
+		return "udp"
+	default:
+		return "both"
+	}
+}
+
 func findElementByAttr(n *html.Node, attribute, value string) *html.Node {
 	if n.Type == html.ElementNode {
 		for _, attr := range n.Attr {
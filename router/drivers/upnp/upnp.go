@@ -0,0 +1,143 @@
+// Package upnp implements router.Driver against any UPnP Internet Gateway
+// Device (IGD) that exposes WANIPConnection or WANPPPConnection, using
+// goupnp instead of the device-specific HTML scraping the arris driver
+// needs. This covers most consumer routers that aren't an Arris NVG443B.
+package upnp
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/huin/goupnp/dcps/internetgateway2"
+	"github.com/huin/goupnp/soap"
+	"github.com/misleb/nodeport-router/router"
+)
+
+// upnpErrorSpecifiedArrayIndexInvalid is the UPnP error code
+// GetGenericPortMappingEntry returns once NewPortMappingIndex is past the
+// end of the port mapping table. It's the only error ListForwards treats as
+// "done", so a genuine transport/device fault doesn't get misread as an
+// empty table.
+const upnpErrorSpecifiedArrayIndexInvalid = 713
+
+// wanConnection is the subset of the generated WANIPConnection1/2 and
+// WANPPPConnection1 clients that we drive. goupnp generates a distinct type
+// per service version, so we narrow to the calls we actually use.
+type wanConnection interface {
+	AddPortMapping(NewRemoteHost string, NewExternalPort uint16, NewProtocol string, NewInternalPort uint16, NewInternalClient string, NewEnabled bool, NewPortMappingDescription string, NewLeaseDuration uint32) error
+	DeletePortMapping(NewRemoteHost string, NewExternalPort uint16, NewProtocol string) error
+	GetGenericPortMappingEntry(NewPortMappingIndex uint16) (NewRemoteHost string, NewExternalPort uint16, NewProtocol string, NewInternalPort uint16, NewInternalClient string, NewEnabled bool, NewPortMappingDescription string, NewLeaseDuration uint32, err error)
+}
+
+// Client drives a UPnP IGD's port mapping service.
+type Client struct {
+	internalClient string // LAN IP of the device forwards should point at, e.g. the cluster node's address
+	conn           wanConnection
+}
+
+// New discovers a UPnP IGD on the LAN and returns a Client that maps ports
+// to internalClient (the node/device whose address forwards should target).
+func New(internalClient string) (*Client, error) {
+	if clients, _, err := internetgateway2.NewWANIPConnection1Clients(); err == nil && len(clients) > 0 {
+		return &Client{internalClient: internalClient, conn: clients[0]}, nil
+	}
+	if clients, _, err := internetgateway2.NewWANIPConnection2Clients(); err == nil && len(clients) > 0 {
+		return &Client{internalClient: internalClient, conn: clients[0]}, nil
+	}
+	if clients, _, err := internetgateway2.NewWANPPPConnection1Clients(); err == nil && len(clients) > 0 {
+		return &Client{internalClient: internalClient, conn: clients[0]}, nil
+	}
+	return nil, fmt.Errorf("no UPnP IGD with a WAN connection service found on the LAN")
+}
+
+// Login is a no-op: UPnP IGD control has no session/auth concept.
+func (c *Client) Login() error {
+	return nil
+}
+
+func (c *Client) AddForward(forward router.Forward) error {
+	port, err := forwardPort(forward.Ports)
+	if err != nil {
+		return fmt.Errorf("parsing external port for %s: %v", forward.ServiceName, err)
+	}
+	internalPort, err := forwardPort(forward.DevicePort)
+	if err != nil {
+		return fmt.Errorf("parsing internal port for %s: %v", forward.ServiceName, err)
+	}
+
+	for _, protocol := range protocols(forward.Protocol) {
+		if err := c.conn.AddPortMapping("", port, protocol, internalPort, c.internalClient, true, forward.ServiceName, 0); err != nil {
+			return fmt.Errorf("adding %s port mapping for %s: %v", protocol, forward.ServiceName, err)
+		}
+	}
+
+	return nil
+}
+
+func (c *Client) DeleteForward(forward router.Forward) error {
+	port, err := forwardPort(forward.Ports)
+	if err != nil {
+		return fmt.Errorf("parsing external port for %s: %v", forward.ServiceName, err)
+	}
+
+	var lastErr error
+	for _, protocol := range protocols(forward.Protocol) {
+		if err := c.conn.DeletePortMapping("", port, protocol); err != nil {
+			lastErr = fmt.Errorf("deleting %s port mapping for %s: %v", protocol, forward.ServiceName, err)
+		}
+	}
+
+	return lastErr
+}
+
+// protocols expands a Forward's "tcp"/"udp"/"both"/"" protocol into the
+// UPnP protocol names AddPortMapping/DeletePortMapping expect.
+func protocols(protocol string) []string {
+	switch protocol {
+	case "tcp", "TCP":
+		return []string{"TCP"}
+	case "udp", "UDP":
+		return []string{"UDP"}
+	default:
+		return []string{"TCP", "UDP"}
+	}
+}
+
+// ListForwards enumerates the IGD's port mapping table via the generic
+// index-based entry call, stopping at the first "no more entries" error.
+func (c *Client) ListForwards() ([]router.Forward, error) {
+	var forwards []router.Forward
+	for i := uint16(0); ; i++ {
+		remoteHost, externalPort, protocol, internalPort, _, _, description, _, err := c.conn.GetGenericPortMappingEntry(i)
+		if err != nil {
+			var fault *soap.SOAPFaultError
+			if errors.As(err, &fault) && fault.Detail.UPnPError.Errorcode == upnpErrorSpecifiedArrayIndexInvalid {
+				// Expected: the IGD signals end-of-table this way rather than
+				// returning a short list.
+				break
+			}
+			return nil, fmt.Errorf("getting port mapping entry %d: %v", i, err)
+		}
+		forwards = append(forwards, router.Forward{
+			PublicIP:    remoteHost,
+			ServiceName: description,
+			Ports:       strconv.Itoa(int(externalPort)),
+			DevicePort:  strconv.Itoa(int(internalPort)),
+			Protocol:    strings.ToLower(protocol),
+		})
+	}
+	return forwards, nil
+}
+
+func forwardPort(s string) (uint16, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	return uint16(port), nil
+}
+
+// compile-time assertion that Client satisfies router.Driver.
+var _ router.Driver = (*Client)(nil)